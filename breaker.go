@@ -1,7 +1,9 @@
 package breaker
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +17,56 @@ type HandlerFunc func() error
 // ErrTimeout describes when a timeout threshold is exceeded.
 var ErrTimeout = errors.New("Timeout execeed in circuit breaker.")
 
+// ErrBreakerOpen is returned by Do when the Breaker is in the
+// Open state and is short-circuiting calls instead of invoking
+// the HandlerFunc.
+var ErrBreakerOpen = errors.New("Circuit breaker is open.")
+
+// PanicError wraps the value recovered from a HandlerFunc that
+// panicked instead of returning an error. It is always counted as a
+// failure, regardless of any installed failure classifier, and is
+// returned to the caller in place of the panic.
+type PanicError struct {
+	Value interface{}
+}
+
+// Error implements the error interface for PanicError.
+func (e PanicError) Error() string {
+	return fmt.Sprintf("breaker: handler panicked: %v", e.Value)
+}
+
+// State describes the current position of a Breaker's
+// internal state machine.
+type State int
+
+const (
+	// StateClosed means the Breaker is allowing calls through
+	// and accumulating failures towards its threshold.
+	StateClosed State = iota
+
+	// StateOpen means the Breaker is short-circuiting all calls
+	// until its reset timeout elapses.
+	StateOpen
+
+	// StateHalfOpen means the Breaker's reset timeout has elapsed
+	// and it is allowing calls through to probe for recovery.
+	StateHalfOpen
+)
+
+// String returns a human readable name for a State.
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
 // Breaker is a struct that behaves similar
 // to Martin Fowler's CircuitBreaker design pattern,
 // but keeps track of failure counts and changes state accordingly.
@@ -23,14 +75,327 @@ type Breaker struct {
 	threshold uint64
 	failures  uint64
 	mu        sync.RWMutex
+
+	state            State
+	resetTimeout     time.Duration
+	successThreshold uint64
+	successes        uint64
+	openedAt         time.Time
+
+	onStateChange func(from, to State)
+
+	// halfOpenInFlight gates HalfOpen so only a single probe call is
+	// admitted at a time; it is set via CAS when a call is admitted
+	// and cleared once that call's outcome has been recorded.
+	halfOpenInFlight int32
+
+	// defaultTimeout, if non-zero, is applied to every DoContext
+	// call via context.WithTimeout, so callers that already pass a
+	// bounded context are not required to set one themselves.
+	defaultTimeout time.Duration
+
+	// failureCondition decides whether ctx.Err() counts as a
+	// failure toward the Breaker's trip threshold when ctx is
+	// done before f returns for a reason other than its deadline.
+	failureCondition func(error) bool
+
+	// failureClassifier decides whether an error returned by f
+	// counts as a failure toward the Breaker's trip threshold. A
+	// PanicError always counts, regardless of this classifier.
+	failureClassifier func(error) bool
+
+	// pending accumulates state transitions recorded by setState
+	// until notifyPending delivers them to onStateChange once b.mu
+	// has been released, so a callback that calls back into the
+	// Breaker (e.g. GetState) cannot deadlock on the mutex.
+	pending []transition
+
+	// Sliding-window fields, only populated for Breakers created
+	// via NewSlidingWindowBreaker. windowSize > 0 enables
+	// ratio-based tripping in place of the raw failure counter.
+	windowBuckets  []windowBucket
+	windowSize     int
+	windowDuration time.Duration
+	bucketDuration time.Duration
+	failureRatio   float64
+}
+
+// transition records a single State change awaiting delivery to an
+// OnStateChange callback.
+type transition struct {
+	from, to State
+}
+
+// windowBucket aggregates the outcomes observed during a single
+// slice of a sliding window's duration.
+type windowBucket struct {
+	start     time.Time
+	successes uint64
+	failures  uint64
+	timeouts  uint64
+}
+
+// outcome describes the result of a single Do call, as recorded
+// against a Breaker's state machine and, for sliding-window
+// Breakers, its window buckets.
+type outcome int
+
+const (
+	outcomeFailure outcome = iota
+	outcomeTimeout
+	outcomeSuccess
+)
+
+// Option configures optional behavior on a Breaker constructed via
+// NewBreaker or NewSlidingWindowBreaker.
+type Option func(*Breaker)
+
+// WithTimeout sets a default timeout that DoContext applies to
+// every call via context.WithTimeout, so callers are not required
+// to bound their own context. It also applies to Do, which calls
+// DoContext with a context bounded by its timeout argument, so the
+// shorter of the two timeouts takes effect.
+func WithTimeout(d time.Duration) Option {
+	return func(b *Breaker) {
+		b.defaultTimeout = d
+	}
+}
+
+// WithFailureCondition overrides whether ctx.Err() counts as a
+// failure toward the Breaker's trip threshold when DoContext's ctx is
+// done before f returns for a reason other than its deadline. The
+// default treats context.Canceled as not a failure, since it reflects
+// the caller giving up rather than the handler misbehaving, and every
+// other ctx.Err() as a failure. A context.DeadlineExceeded is always
+// recorded as a timeout and is not passed to the condition; errors
+// returned by f are judged by WithFailureClassifier instead.
+func WithFailureCondition(f func(error) bool) Option {
+	return func(b *Breaker) {
+		b.failureCondition = f
+	}
+}
+
+// defaultFailureCondition is the failure condition used when
+// WithFailureCondition is not supplied.
+func defaultFailureCondition(err error) bool {
+	return err != context.Canceled
+}
+
+// WithFailureClassifier overrides which errors returned by a
+// HandlerFunc count as failures toward the Breaker's trip
+// threshold. This lets callers exclude errors they don't consider
+// the breaker's concern, such as client-side validation errors,
+// while still returning them from Do/DoContext. A PanicError always
+// counts as a failure, regardless of the classifier. The default
+// classifier counts every non-nil error.
+func WithFailureClassifier(f func(error) bool) Option {
+	return func(b *Breaker) {
+		b.failureClassifier = f
+	}
+}
+
+// defaultFailureClassifier is the failure classifier used when
+// WithFailureClassifier is not supplied.
+func defaultFailureClassifier(err error) bool {
+	return true
 }
 
 // NewBreaker creates and returns a pointer to a new Breaker
-// with a failure threshold of the passed in value.
-func NewBreaker(threshold uint64) *Breaker {
-	return &Breaker{
-		threshold: threshold,
-		failures:  0,
+// with a failure threshold of the passed in value, a timeout
+// to wait before transitioning from Open to HalfOpen, and a
+// number of consecutive successes required in HalfOpen before
+// the Breaker closes again.
+func NewBreaker(threshold uint64, resetTimeout time.Duration, successThreshold uint64, opts ...Option) *Breaker {
+	b := &Breaker{
+		threshold:         threshold,
+		failures:          0,
+		state:             StateClosed,
+		resetTimeout:      resetTimeout,
+		successThreshold:  successThreshold,
+		failureCondition:  defaultFailureCondition,
+		failureClassifier: defaultFailureClassifier,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
+}
+
+// NewSlidingWindowBreaker creates and returns a pointer to a new
+// Breaker that trips based on the ratio of failed calls (failures
+// and timeouts) to total calls observed over a rolling window,
+// rather than a raw cumulative failure count. The window is divided
+// into windowSize buckets; the Breaker only trips once at least
+// windowSize samples have been observed within window and the
+// failure ratio exceeds failureRatio. Use GetState/OnStateChange to
+// observe recovery the same way as a threshold-based Breaker.
+// windowSize must be greater than zero, and window must be large
+// enough to divide into windowSize non-empty buckets;
+// NewSlidingWindowBreaker panics otherwise, since either cannot be
+// satisfied.
+func NewSlidingWindowBreaker(windowSize int, failureRatio float64, window time.Duration, opts ...Option) *Breaker {
+	if windowSize <= 0 {
+		panic("breaker: NewSlidingWindowBreaker: windowSize must be > 0")
+	}
+
+	bucketDuration := window / time.Duration(windowSize)
+	if bucketDuration <= 0 {
+		panic("breaker: NewSlidingWindowBreaker: window is too small to divide into windowSize buckets")
+	}
+
+	b := NewBreaker(0, window, 1, opts...)
+	b.windowSize = windowSize
+	b.failureRatio = failureRatio
+	b.windowDuration = window
+	b.bucketDuration = bucketDuration
+	b.windowBuckets = make([]windowBucket, windowSize)
+
+	now := time.Now()
+	for i := range b.windowBuckets {
+		b.windowBuckets[i].start = now
+	}
+
+	return b
+}
+
+// Counts returns the aggregate success, failure, and timeout counts
+// observed over the current rolling window. It is only meaningful
+// for Breakers created with NewSlidingWindowBreaker.
+func (b *Breaker) Counts() (successes, failures, timeouts uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for i := range b.windowBuckets {
+		bucket := &b.windowBuckets[i]
+		if now.Sub(bucket.start) >= b.windowDuration {
+			continue
+		}
+
+		successes += bucket.successes
+		failures += bucket.failures
+		timeouts += bucket.timeouts
+	}
+
+	return
+}
+
+// currentBucket returns the window bucket that the given time falls
+// into, resetting it first if its contents have aged out of the
+// window. Callers must hold b.mu.
+func (b *Breaker) currentBucket(now time.Time) *windowBucket {
+	idx := int((now.UnixNano() / int64(b.bucketDuration)) % int64(len(b.windowBuckets)))
+	bucket := &b.windowBuckets[idx]
+
+	if now.Sub(bucket.start) >= b.windowDuration {
+		*bucket = windowBucket{start: now}
+	}
+
+	return bucket
+}
+
+// windowTotals returns the total sample count and the number of
+// failed samples (failures and timeouts) across all buckets that
+// are still within the window as of now. Callers must hold b.mu.
+func (b *Breaker) windowTotals(now time.Time) (total, failed uint64) {
+	for i := range b.windowBuckets {
+		bucket := &b.windowBuckets[i]
+		if now.Sub(bucket.start) >= b.windowDuration {
+			continue
+		}
+
+		total += bucket.successes + bucket.failures + bucket.timeouts
+		failed += bucket.failures + bucket.timeouts
+	}
+
+	return
+}
+
+// OnStateChange registers a callback that is invoked whenever the
+// Breaker transitions from one State to another. It is called from
+// whichever goroutine triggered the transition, after that
+// goroutine has released the Breaker's internal lock, so the
+// callback is free to call back into the Breaker (GetState, Do,
+// IsOpen, and so on) without deadlocking.
+func (b *Breaker) OnStateChange(f func(from, to State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.onStateChange = f
+}
+
+// GetState returns the Breaker's current State, accounting for
+// whether an Open Breaker's reset timeout has elapsed.
+func (b *Breaker) GetState() State {
+	b.mu.Lock()
+	defer b.notifyPending()
+	defer b.mu.Unlock()
+
+	return b.currentState()
+}
+
+// currentState returns the effective state, transitioning an Open
+// Breaker to HalfOpen if its reset timeout has elapsed. Callers
+// must hold b.mu.
+func (b *Breaker) currentState() State {
+	if b.state == StateOpen && time.Since(b.openedAt) >= b.resetTimeout {
+		b.setState(StateHalfOpen)
+	}
+
+	return b.state
+}
+
+// setState transitions the Breaker to the given State, queuing the
+// registered OnStateChange callback (if any) to run once notifyPending
+// is called. Callers must hold b.mu and must arrange for
+// notifyPending to run after releasing it.
+func (b *Breaker) setState(to State) {
+	from := b.state
+	if from == to {
+		return
+	}
+
+	b.state = to
+
+	switch to {
+	case StateOpen:
+		b.openedAt = time.Now()
+		atomic.StoreUint64(&b.successes, 0)
+		atomic.StoreInt32(&b.halfOpenInFlight, 0)
+	case StateHalfOpen:
+		atomic.StoreUint64(&b.successes, 0)
+		atomic.StoreInt32(&b.halfOpenInFlight, 0)
+	case StateClosed:
+		atomic.StoreUint64(&b.failures, 0)
+		atomic.StoreUint64(&b.successes, 0)
+		atomic.StoreInt32(&b.halfOpenInFlight, 0)
+	}
+
+	if b.onStateChange != nil {
+		b.pending = append(b.pending, transition{from, to})
+	}
+}
+
+// notifyPending delivers any state transitions queued by setState to
+// the registered OnStateChange callback. It acquires b.mu itself to
+// drain the queue, so callers must invoke it only after releasing
+// any lock they already hold, guaranteeing the callback never runs
+// while b.mu is held.
+func (b *Breaker) notifyPending() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	cb := b.onStateChange
+	b.mu.Unlock()
+
+	if cb == nil {
+		return
+	}
+
+	for _, t := range pending {
+		cb(t.from, t.to)
 	}
 }
 
@@ -38,14 +403,14 @@ func NewBreaker(threshold uint64) *Breaker {
 // has a failure count above its failure threshold.
 // Returns false otherwise.
 func (b *Breaker) IsOpen() bool {
-	return b.loadFailures() >= b.loadThreshold()
+	return b.GetState() == StateOpen
 }
 
 // IsClosed returns true if the current Breaker
 // has a failure count below its failure threshold.
 // Returns false otherwise.
 func (b *Breaker) IsClosed() bool {
-	return b.loadFailures() < b.loadThreshold()
+	return b.GetState() == StateClosed
 }
 
 func (b *Breaker) loadFailures() uint64 {
@@ -56,72 +421,211 @@ func (b *Breaker) loadThreshold() uint64 {
 	return atomic.LoadUint64(&b.threshold)
 }
 
-// Trip increments the failure count of the current Breaker.
+// tryEnter decides whether a call may proceed given the Breaker's
+// current state. Open rejects every call. HalfOpen admits at most
+// one call at a time via halfOpenInFlight, so a recovering backend
+// is probed one request at a time rather than with full concurrent
+// traffic; callers admitted as a probe must clear halfOpenInFlight
+// once the call's outcome has been recorded.
+func (b *Breaker) tryEnter() (allowed, probe bool) {
+	b.mu.Lock()
+	state := b.currentState()
+	b.mu.Unlock()
+
+	b.notifyPending()
+
+	switch state {
+	case StateOpen:
+		return false, false
+	case StateHalfOpen:
+		if !atomic.CompareAndSwapInt32(&b.halfOpenInFlight, 0, 1) {
+			return false, false
+		}
+		return true, true
+	default:
+		return true, false
+	}
+}
+
+// Trip records a failed call against the current Breaker, tripping
+// it to Open once its failure count reaches its failure threshold
+// (or, for a sliding-window Breaker, once its failure ratio is
+// exceeded).
 func (b *Breaker) Trip() {
-	atomic.AddUint64(&b.failures, 1)
+	b.record(outcomeFailure)
+}
+
+// tripTimeout records a timed-out call against the current Breaker.
+// It is equivalent to Trip, except that sliding-window Breakers
+// track it separately for Counts().
+func (b *Breaker) tripTimeout() {
+	b.record(outcomeTimeout)
+}
+
+// recordSuccess records a successful call against the Breaker,
+// closing a HalfOpen Breaker once the success threshold is met.
+func (b *Breaker) recordSuccess() {
+	b.record(outcomeSuccess)
 }
 
-// Reset resets the current Breaker's failure count to zero.
+// record applies a single call outcome to the Breaker's window
+// buckets (if any) and state machine.
+func (b *Breaker) record(o outcome) {
+	b.mu.Lock()
+	defer b.notifyPending()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	if b.windowSize > 0 {
+		bucket := b.currentBucket(now)
+		switch o {
+		case outcomeSuccess:
+			bucket.successes++
+		case outcomeFailure:
+			bucket.failures++
+		case outcomeTimeout:
+			bucket.timeouts++
+		}
+	}
+
+	switch b.currentState() {
+	case StateHalfOpen:
+		if o != outcomeSuccess {
+			b.setState(StateOpen)
+			return
+		}
+
+		atomic.AddUint64(&b.successes, 1)
+		if atomic.LoadUint64(&b.successes) >= b.successThreshold {
+			b.setState(StateClosed)
+		}
+
+	case StateClosed:
+		if o == outcomeSuccess {
+			return
+		}
+
+		if b.windowSize > 0 {
+			total, failed := b.windowTotals(now)
+			if total >= uint64(b.windowSize) && float64(failed)/float64(total) > b.failureRatio {
+				b.setState(StateOpen)
+			}
+			return
+		}
+
+		atomic.AddUint64(&b.failures, 1)
+		if b.loadFailures() >= b.loadThreshold() {
+			b.setState(StateOpen)
+		}
+	}
+}
+
+// Reset resets the current Breaker's failure count (and, for a
+// sliding-window Breaker, its window buckets) to zero and returns
+// it to the Closed state.
 func (b *Breaker) Reset() {
+	b.mu.Lock()
+	defer b.notifyPending()
+	defer b.mu.Unlock()
+
 	atomic.StoreUint64(&b.failures, 0)
+
+	if b.windowSize > 0 {
+		now := time.Now()
+		for i := range b.windowBuckets {
+			b.windowBuckets[i] = windowBucket{start: now}
+		}
+	}
+
+	b.setState(StateClosed)
 }
 
-// Do calls the HandlerFunc associated with the current Breaker
-// with the passed in arguments. Returns
+// Do calls the HandlerFunc associated with the current Breaker.
+// Returns ErrBreakerOpen without calling f if the Breaker is Open,
+// ErrTimeout if f does not complete within timeout, or the error
+// returned by f. It is a convenience wrapper around DoContext for
+// callers that want a per-call timeout rather than a context.
 func (b *Breaker) Do(f HandlerFunc, timeout time.Duration) error {
-	timerChan := make(chan bool, 1)
-	errChan := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	defer close(timerChan)
-	defer close(errChan)
+	return b.DoContext(ctx, f)
+}
 
-	var once sync.Once
-	var done sync.WaitGroup
-	done.Add(1)
+// DoContext calls the HandlerFunc associated with the current
+// Breaker, honoring cancelation and deadlines on ctx. It returns
+// ErrBreakerOpen without calling f if the Breaker is Open,
+// ErrTimeout if ctx's deadline is exceeded before f returns, or the
+// error returned by f (including ctx.Err() if ctx is canceled
+// before f returns). f is always run in its own goroutine so a
+// handler that never returns cannot block the caller; that
+// goroutine's result is discarded once DoContext has returned. A
+// panicking f is recovered and surfaced to the caller as a
+// PanicError instead of crashing the process.
+//
+// An exceeded deadline is always recorded as a timeout. Whether any
+// other ctx.Err() counts as a failure toward the Breaker's trip
+// threshold is decided by the failure condition installed via
+// WithFailureCondition (context.Canceled does not count, by
+// default). Whether an error returned by f counts is decided by the
+// classifier installed via WithFailureClassifier (every non-nil
+// error counts, by default); a PanicError always counts.
+//
+// While HalfOpen, DoContext admits only one call at a time as a
+// probe of the recovering backend; concurrent callers are
+// short-circuited with ErrBreakerOpen until that probe's outcome is
+// recorded.
+func (b *Breaker) DoContext(ctx context.Context, f HandlerFunc) error {
+	allowed, probe := b.tryEnter()
+	if !allowed {
+		return ErrBreakerOpen
+	}
 
-	// Setup a timer goroutine to
-	// ensure the function runs within a timeout
-	go func() {
-		time.Sleep(timeout)
+	if probe {
+		defer atomic.StoreInt32(&b.halfOpenInFlight, 0)
+	}
 
-		once.Do(func() {
-			timerChan <- true
-			done.Done()
-		})
-	}()
+	if b.defaultTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.defaultTimeout)
+		defer cancel()
+	}
 
-	// Setup a goroutine that runs the desired function
-	// and sends any error on the error channel
-	go func() {
-		err := f()
+	errChan := make(chan error, 1)
 
-		once.Do(func() {
-			if err != nil {
-				errChan <- err
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errChan <- PanicError{Value: r}
 			}
+		}()
 
-			done.Done()
-		})
+		errChan <- f()
 	}()
 
-	// Wait for either the timeout
-	// or the function goroutine to complete
-	done.Wait()
+	select {
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			b.tripTimeout()
+			return ErrTimeout
+		}
 
-	var ret error
+		if b.failureCondition(ctx.Err()) {
+			b.Trip()
+		}
 
-	select {
-	case <-timerChan:
-		b.Trip()
-		ret = ErrTimeout
+		return ctx.Err()
 
-	case e := <-errChan:
-		b.Trip()
-		ret = e
+	case err := <-errChan:
+		if err != nil {
+			if _, panicked := err.(PanicError); panicked || b.failureClassifier(err) {
+				b.Trip()
+			}
+		} else {
+			b.recordSuccess()
+		}
 
-	default:
-		ret = nil
+		return err
 	}
-
-	return ret
 }
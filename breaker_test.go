@@ -1,14 +1,16 @@
 package breaker
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestNew(t *testing.T) {
-	b := NewBreaker(1)
+	b := NewBreaker(1, time.Second, 1)
 
 	if b.threshold != 1 {
 		t.Errorf("Unexpected threshold for new breaker: %d", b.threshold)
@@ -24,7 +26,7 @@ func TestNew(t *testing.T) {
 }
 
 func TestIsOpen(t *testing.T) {
-	b := NewBreaker(1)
+	b := NewBreaker(1, time.Second, 1)
 
 	if b.IsOpen() {
 		t.Errorf("A new breaker should not be open")
@@ -38,7 +40,7 @@ func TestIsOpen(t *testing.T) {
 }
 
 func TestIsClosed(t *testing.T) {
-	b := NewBreaker(1)
+	b := NewBreaker(1, time.Second, 1)
 
 	if !b.IsClosed() {
 		t.Errorf("A new breaker should be closed")
@@ -52,7 +54,7 @@ func TestIsClosed(t *testing.T) {
 }
 
 func TestTrip(t *testing.T) {
-	b := NewBreaker(1)
+	b := NewBreaker(1, time.Second, 1)
 
 	b.Trip()
 	if b.failures != 1 {
@@ -61,7 +63,7 @@ func TestTrip(t *testing.T) {
 }
 
 func TestReset(t *testing.T) {
-	b := NewBreaker(1)
+	b := NewBreaker(1, time.Second, 1)
 
 	b.Trip()
 	b.Reset()
@@ -75,7 +77,7 @@ func TestReset(t *testing.T) {
 }
 
 func TestDo(t *testing.T) {
-	b := NewBreaker(1)
+	b := NewBreaker(1, time.Second, 1)
 	b.Do(func() error {
 		return errors.New("Test Error")
 	}, 0)
@@ -84,7 +86,7 @@ func TestDo(t *testing.T) {
 		t.Errorf("Expected a function that throws an error to close the breaker")
 	}
 
-	b2 := NewBreaker(1)
+	b2 := NewBreaker(1, time.Second, 1)
 	b2.Do(func() error {
 		time.Sleep(time.Second)
 		return nil
@@ -94,7 +96,7 @@ func TestDo(t *testing.T) {
 		t.Errorf("Expected a function that times out to trip the breaker")
 	}
 
-	b3 := NewBreaker(1)
+	b3 := NewBreaker(1, time.Second, 1)
 	err := b3.Do(func() error {
 		return nil
 	}, time.Second)
@@ -104,8 +106,153 @@ func TestDo(t *testing.T) {
 	}
 }
 
+func TestDoWhenOpen(t *testing.T) {
+	b := NewBreaker(1, time.Hour, 1)
+	b.Trip()
+
+	err := b.Do(func() error {
+		t.Errorf("HandlerFunc should not be invoked while the breaker is open")
+		return nil
+	}, time.Second)
+
+	if err != ErrBreakerOpen {
+		t.Errorf("Expected ErrBreakerOpen, got: %v", err)
+	}
+}
+
+func TestHalfOpenRecovery(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond, 2)
+	b.Trip()
+
+	if b.GetState() != StateOpen {
+		t.Errorf("Expected breaker to be open after tripping")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if b.GetState() != StateHalfOpen {
+		t.Errorf("Expected breaker to transition to half-open after reset timeout elapses")
+	}
+
+	b.recordSuccess()
+	if b.GetState() != StateHalfOpen {
+		t.Errorf("Expected breaker to remain half-open before success threshold is met")
+	}
+
+	b.recordSuccess()
+	if b.GetState() != StateClosed {
+		t.Errorf("Expected breaker to close after success threshold is met")
+	}
+}
+
+func TestHalfOpenFailureReopens(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond, 2)
+	b.Trip()
+
+	time.Sleep(2 * time.Millisecond)
+
+	if b.GetState() != StateHalfOpen {
+		t.Errorf("Expected breaker to transition to half-open after reset timeout elapses")
+	}
+
+	b.Trip()
+	if b.GetState() != StateOpen {
+		t.Errorf("Expected a failure in half-open to reopen the breaker")
+	}
+}
+
+func TestHalfOpenAdmitsOnlyOneProbe(t *testing.T) {
+	b := NewBreaker(1, time.Millisecond, 2)
+	b.Trip()
+
+	time.Sleep(2 * time.Millisecond)
+
+	if b.GetState() != StateHalfOpen {
+		t.Fatalf("Expected breaker to transition to half-open after reset timeout elapses")
+	}
+
+	var running, maxRunning, rejected int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := b.DoContext(context.Background(), func() error {
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+
+				for {
+					old := atomic.LoadInt32(&maxRunning)
+					if n <= old || atomic.CompareAndSwapInt32(&maxRunning, old, n) {
+						break
+					}
+				}
+
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+
+			if err == ErrBreakerOpen {
+				atomic.AddInt32(&rejected, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if maxRunning > 1 {
+		t.Errorf("Expected at most one concurrent probe while half-open, saw %d", maxRunning)
+	}
+
+	if rejected == 0 {
+		t.Errorf("Expected concurrent callers to be short-circuited while a half-open probe is in flight")
+	}
+}
+
+func TestOnStateChange(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1)
+
+	var from, to State
+	b.OnStateChange(func(f, t State) {
+		from, to = f, t
+	})
+
+	b.Trip()
+
+	if from != StateClosed || to != StateOpen {
+		t.Errorf("Expected OnStateChange callback to report closed->open, got %v->%v", from, to)
+	}
+}
+
+func TestOnStateChangeCanCallBackIntoBreaker(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1)
+
+	var observed State
+	b.OnStateChange(func(from, to State) {
+		observed = b.GetState()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		b.Trip()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Trip deadlocked when its OnStateChange callback called back into the breaker")
+	}
+
+	if observed != StateOpen {
+		t.Errorf("Expected the callback's GetState() to observe StateOpen, got %v", observed)
+	}
+}
+
 func TestTripAsync(t *testing.T) {
-	b := NewBreaker(10)
+	b := NewBreaker(10, time.Second, 1)
 
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -137,3 +284,212 @@ func TestTripAsync(t *testing.T) {
 		t.Errorf("Breaker should not be closed.")
 	}
 }
+
+func TestSlidingWindowBreakerTripsOnRatio(t *testing.T) {
+	b := NewSlidingWindowBreaker(4, 0.5, time.Minute)
+
+	b.Trip()
+	b.Trip()
+
+	if b.IsOpen() {
+		t.Errorf("Breaker should not trip before the minimum sample count is reached")
+	}
+
+	b.recordSuccess()
+	b.recordSuccess()
+
+	if b.IsOpen() {
+		t.Errorf("Breaker should not trip when the failure ratio is at 50%%")
+	}
+
+	b.Trip()
+
+	if !b.IsOpen() {
+		t.Errorf("Breaker should trip once the failure ratio exceeds 50%%")
+	}
+}
+
+func TestSlidingWindowBreakerCounts(t *testing.T) {
+	b := NewSlidingWindowBreaker(10, 0.9, time.Minute)
+
+	b.recordSuccess()
+	b.Trip()
+	b.tripTimeout()
+
+	successes, failures, timeouts := b.Counts()
+	if successes != 1 || failures != 1 || timeouts != 1 {
+		t.Errorf("Unexpected Counts(): successes=%d failures=%d timeouts=%d", successes, failures, timeouts)
+	}
+}
+
+func TestDoContextDeadlineExceededTripsTimeout(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	err := b.DoContext(ctx, func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+
+	if !b.IsOpen() {
+		t.Errorf("Expected a deadline exceeded call to trip the breaker")
+	}
+}
+
+func TestDoContextCancelDoesNotTripByDefault(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		b.DoContext(ctx, func() error {
+			<-done
+			return nil
+		})
+		close(done)
+	}()
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	if b.IsOpen() {
+		t.Errorf("Expected a canceled call to not trip the breaker by default")
+	}
+}
+
+func TestDoContextCustomFailureConditionCountsCancel(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1, WithFailureCondition(func(err error) bool {
+		return true
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		b.DoContext(ctx, func() error {
+			<-done
+			return nil
+		})
+		close(done)
+	}()
+
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	if !b.IsOpen() {
+		t.Errorf("Expected a custom failure condition to be able to count cancelation as a failure")
+	}
+}
+
+func TestWithTimeoutAppliesDefaultDeadline(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1, WithTimeout(time.Millisecond))
+
+	err := b.DoContext(context.Background(), func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout from the default timeout, got: %v", err)
+	}
+}
+
+func TestDoContextFailureClassifierExcludesError(t *testing.T) {
+	validationErr := errors.New("validation error")
+
+	b := NewBreaker(1, time.Second, 1, WithFailureClassifier(func(err error) bool {
+		return err != validationErr
+	}))
+
+	err := b.DoContext(context.Background(), func() error {
+		return validationErr
+	})
+
+	if err != validationErr {
+		t.Errorf("Expected the classified error to still be returned, got: %v", err)
+	}
+
+	if b.IsOpen() {
+		t.Errorf("Expected a classified-out error to not trip the breaker")
+	}
+}
+
+func TestDoContextRecoversPanic(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1)
+
+	err := b.DoContext(context.Background(), func() error {
+		panic("boom")
+	})
+
+	pe, ok := err.(PanicError)
+	if !ok {
+		t.Fatalf("Expected a PanicError, got: %T", err)
+	}
+
+	if pe.Value != "boom" {
+		t.Errorf("Expected PanicError to carry the recovered value, got: %v", pe.Value)
+	}
+
+	if !b.IsOpen() {
+		t.Errorf("Expected a panicking handler to trip the breaker")
+	}
+}
+
+func TestDoContextPanicAlwaysCountsDespiteClassifier(t *testing.T) {
+	b := NewBreaker(1, time.Second, 1, WithFailureClassifier(func(err error) bool {
+		return false
+	}))
+
+	b.DoContext(context.Background(), func() error {
+		panic("boom")
+	})
+
+	if !b.IsOpen() {
+		t.Errorf("Expected a PanicError to trip the breaker even when the classifier excludes everything")
+	}
+}
+
+func TestNewSlidingWindowBreakerPanicsOnInvalidWindowSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected NewSlidingWindowBreaker to panic when windowSize <= 0")
+		}
+	}()
+
+	NewSlidingWindowBreaker(0, 0.5, time.Minute)
+}
+
+func TestNewSlidingWindowBreakerPanicsOnTooSmallWindow(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected NewSlidingWindowBreaker to panic when window can't divide into windowSize non-empty buckets")
+		}
+	}()
+
+	NewSlidingWindowBreaker(2000, 0.5, 100*time.Nanosecond)
+}
+
+func TestSlidingWindowBreakerForgetsOldSamples(t *testing.T) {
+	b := NewSlidingWindowBreaker(2, 0.5, 10*time.Millisecond)
+
+	b.Trip()
+	b.Trip()
+
+	if !b.IsOpen() {
+		t.Errorf("Breaker should trip once its minimum sample count is all failures")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	successes, failures, timeouts := b.Counts()
+	if successes != 0 || failures != 0 || timeouts != 0 {
+		t.Errorf("Expected stale samples to age out of the window, got successes=%d failures=%d timeouts=%d", successes, failures, timeouts)
+	}
+}
@@ -0,0 +1,46 @@
+package breaker
+
+import "sync"
+
+// Group manages a set of Breakers keyed by an arbitrary string,
+// typically a downstream host, endpoint, or tenant. Breakers are
+// constructed lazily on first use via New and cached until removed
+// with Delete, so callers can write group.Get(host).Do(...)
+// without building their own map[string]*Breaker and locking.
+type Group struct {
+	// New constructs a Breaker for a key that has not been seen
+	// before.
+	New func() *Breaker
+
+	breakers sync.Map
+}
+
+// Get returns the Breaker for key, constructing and caching one via
+// New if this is the first time key has been requested. Concurrent
+// calls for the same key are safe; if multiple goroutines race to
+// populate the same key for the first time, New may be called more
+// than once, but only one of the resulting Breakers is kept.
+func (g *Group) Get(key string) *Breaker {
+	if b, ok := g.breakers.Load(key); ok {
+		return b.(*Breaker)
+	}
+
+	b, _ := g.breakers.LoadOrStore(key, g.New())
+	return b.(*Breaker)
+}
+
+// Delete removes the Breaker cached for key, if any. A subsequent
+// Get for the same key constructs a fresh Breaker via New.
+func (g *Group) Delete(key string) {
+	g.breakers.Delete(key)
+}
+
+// Range calls f for each key/Breaker pair currently cached in the
+// Group, in no particular order, stopping early if f returns false.
+// See sync.Map.Range for the semantics around keys added or removed
+// concurrently with Range.
+func (g *Group) Range(f func(key string, b *Breaker) bool) {
+	g.breakers.Range(func(k, v interface{}) bool {
+		return f(k.(string), v.(*Breaker))
+	})
+}
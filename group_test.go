@@ -0,0 +1,68 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupGetCreatesAndCaches(t *testing.T) {
+	g := &Group{New: func() *Breaker { return NewBreaker(1, time.Second, 1) }}
+
+	a := g.Get("host-a")
+	b := g.Get("host-a")
+
+	if a != b {
+		t.Errorf("Expected repeated Get calls for the same key to return the same Breaker")
+	}
+
+	other := g.Get("host-b")
+	if other == a {
+		t.Errorf("Expected different keys to return different Breakers")
+	}
+}
+
+func TestGroupDelete(t *testing.T) {
+	g := &Group{New: func() *Breaker { return NewBreaker(1, time.Second, 1) }}
+
+	first := g.Get("host-a")
+	g.Delete("host-a")
+	second := g.Get("host-a")
+
+	if first == second {
+		t.Errorf("Expected a Breaker to be reconstructed after Delete")
+	}
+}
+
+func TestGroupRange(t *testing.T) {
+	g := &Group{New: func() *Breaker { return NewBreaker(1, time.Second, 1) }}
+
+	g.Get("host-a")
+	g.Get("host-b")
+
+	seen := map[string]bool{}
+	g.Range(func(key string, b *Breaker) bool {
+		seen[key] = true
+		return true
+	})
+
+	if !seen["host-a"] || !seen["host-b"] {
+		t.Errorf("Expected Range to visit every cached key, got: %v", seen)
+	}
+}
+
+func TestGroupRangeStopsEarly(t *testing.T) {
+	g := &Group{New: func() *Breaker { return NewBreaker(1, time.Second, 1) }}
+
+	g.Get("host-a")
+	g.Get("host-b")
+
+	count := 0
+	g.Range(func(key string, b *Breaker) bool {
+		count++
+		return false
+	})
+
+	if count != 1 {
+		t.Errorf("Expected Range to stop after the first false return, got %d calls", count)
+	}
+}